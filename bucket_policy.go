@@ -0,0 +1,208 @@
+// Copyright (c) 2020 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// otherBucketLabel is reported for any bucket name the active
+// bucketLabelPolicy does not allow through verbatim when hashing is
+// disabled - the overflow bucket that keeps
+// sidekick_requests_latency_seconds cardinality bounded. With
+// --bucket-label-hash-buckets set, such names get a "bucket-<n>" label
+// instead.
+const otherBucketLabel = "other"
+
+// globalBucketLabelPolicy is the bucket-label cardinality policy applied to
+// every latency observation. It defaults to passing bucket names through
+// unchanged, matching sidekick's historical behaviour when none of
+// --bucket-allow-list, --bucket-allow-regex or --bucket-label-hash-buckets
+// are set.
+var globalBucketLabelPolicy = &bucketLabelPolicy{}
+
+func init() {
+	flag.Func("bucket-allow-list", "comma-separated list of bucket names to keep verbatim in the bucket label, or a path to a file with one bucket name per line; anything else collapses to \"other\"", func(s string) error {
+		if info, err := os.Stat(s); err == nil && !info.IsDir() {
+			allow, err := newBucketLabelPolicyFromFile(s)
+			if err != nil {
+				return fmt.Errorf("reading --bucket-allow-list file %q: %w", s, err)
+			}
+			globalBucketLabelPolicy.allow = allow
+			return nil
+		}
+		globalBucketLabelPolicy.allow = parseBucketAllowList(s)
+		return nil
+	})
+	flag.Func("bucket-allow-regex", "regular expression of bucket names to keep verbatim in the bucket label, in addition to --bucket-allow-list", func(s string) error {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return fmt.Errorf("invalid --bucket-allow-regex %q: %w", s, err)
+		}
+		globalBucketLabelPolicy.allowRegex = re
+		return nil
+	})
+	flag.Func("bucket-label-hash-buckets", "bound bucket-label cardinality by hashing any bucket name not allow-listed into this many \"bucket-<n>\" buckets instead of \"other\" (0 disables hashing)", func(s string) error {
+		v, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid --bucket-label-hash-buckets %q: %w", s, err)
+		}
+		globalBucketLabelPolicy.hashBuckets = uint32(v)
+		return nil
+	})
+}
+
+// bucketLabelPolicy bounds the cardinality of the "bucket" label sidekick
+// attaches to its request metrics. Sidekick can front arbitrary, possibly
+// multi-tenant, HTTP traffic, so the bucket name taken from the first path
+// segment is not trustworthy as a label value on its own - a noisy or
+// adversarial client can otherwise blow up the latency histogram's series
+// count.
+type bucketLabelPolicy struct {
+	// allow, when non-nil, is the set of bucket names let through
+	// verbatim; anything else becomes otherBucketLabel. Populated via
+	// --bucket-allow-list (a comma-separated list or a file path, one
+	// bucket per line).
+	allow map[string]struct{}
+
+	// allowRegex, when set, additionally allows any bucket name it
+	// matches, populated via --bucket-allow-regex.
+	allowRegex *regexp.Regexp
+
+	// hashBuckets, when > 0, replaces any bucket name not already let
+	// through by allow/allowRegex with "bucket-<n>" where n is in
+	// [0, hashBuckets), bounding cardinality without dropping the label
+	// entirely. Populated via --bucket-label-hash-buckets.
+	hashBuckets uint32
+}
+
+// newBucketLabelPolicyFromFile builds a bucketLabelPolicy allow-list from a
+// file containing one bucket name per line (blank lines and lines starting
+// with '#' are ignored), for use with --bucket-allow-list when it names a
+// file rather than an inline comma-separated list.
+func newBucketLabelPolicyFromFile(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	allow := map[string]struct{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		allow[line] = struct{}{}
+	}
+	return allow, scanner.Err()
+}
+
+// parseBucketAllowList parses the inline, comma-separated form of
+// --bucket-allow-list ("bucketa,bucketb,bucketc").
+func parseBucketAllowList(csv string) map[string]struct{} {
+	allow := map[string]struct{}{}
+	for _, name := range strings.Split(csv, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			allow[name] = struct{}{}
+		}
+	}
+	return allow
+}
+
+// resolveBucketLabel applies the policy to a bucket name extracted from a
+// request path, returning either the bucket name unchanged, a bounded
+// "bucket-<n>" hash, or otherBucketLabel, and recording a
+// sidekick_metric_labels_dropped_total sample whenever the original name is
+// not used as-is.
+func (p *bucketLabelPolicy) resolveBucketLabel(bucket string) string {
+	if p == nil || (p.allow == nil && p.allowRegex == nil && p.hashBuckets == 0) {
+		return bucket
+	}
+
+	if _, ok := p.allow[bucket]; ok {
+		return bucket
+	}
+	if p.allowRegex != nil && p.allowRegex.MatchString(bucket) {
+		return bucket
+	}
+
+	if p.hashBuckets > 0 {
+		metricLabelsDroppedMetric.WithLabelValues("bucket", "hashed").Inc()
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(bucket))
+		return "bucket-" + strconv.FormatUint(uint64(h.Sum32()%p.hashBuckets), 10)
+	}
+
+	metricLabelsDroppedMetric.WithLabelValues("bucket", "not_allow_listed").Inc()
+	return otherBucketLabel
+}
+
+// classifyOperation derives a bounded-cardinality "op" label from the
+// request method and raw (undecoded) query string, independent of the
+// bucket label, so dashboards can break latency down by S3 operation
+// (GET object / PUT object / ListObjectsV2 / multipart, ...) without
+// multiplying series by bucket name.
+func classifyOperation(method, rawQuery string) string {
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		query = url.Values{}
+	}
+
+	switch {
+	case query.Has("uploads") || query.Has("uploadId"):
+		return "multipart_upload"
+	case query.Has("versioning"):
+		return "versioning"
+	case query.Has("versions"):
+		return "list_object_versions"
+	case query.Has("tagging"):
+		return "tagging"
+	case query.Has("acl"):
+		return "acl"
+	case query.Has("policy"):
+		return "policy"
+	case query.Has("location"):
+		return "location"
+	case query.Get("list-type") == "2":
+		return "list_objects_v2"
+	case query.Has("delimiter") || query.Has("prefix") || query.Has("marker"):
+		return "list_objects"
+	}
+
+	switch strings.ToUpper(method) {
+	case "GET", "HEAD":
+		return strings.ToLower(method) + "_object"
+	case "PUT":
+		return "put_object"
+	case "DELETE":
+		return "delete_object"
+	case "POST":
+		return "post_object"
+	default:
+		return otherBucketLabel
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestBucketLabelPolicy_resolveBucketLabel_passthroughByDefault(t *testing.T) {
+	p := &bucketLabelPolicy{}
+	if got := p.resolveBucketLabel("any-bucket"); got != "any-bucket" {
+		t.Fatalf("got %q, want passthrough", got)
+	}
+}
+
+func TestBucketLabelPolicy_resolveBucketLabel_allowList(t *testing.T) {
+	p := &bucketLabelPolicy{allow: parseBucketAllowList("prod,staging")}
+	if got := p.resolveBucketLabel("prod"); got != "prod" {
+		t.Fatalf("got %q, want %q", got, "prod")
+	}
+	if got := p.resolveBucketLabel("unknown-tenant"); got != otherBucketLabel {
+		t.Fatalf("got %q, want %q", got, otherBucketLabel)
+	}
+}
+
+func TestBucketLabelPolicy_resolveBucketLabel_allowRegex(t *testing.T) {
+	p := &bucketLabelPolicy{allowRegex: regexp.MustCompile(`^tenant-\d+$`)}
+	if got := p.resolveBucketLabel("tenant-42"); got != "tenant-42" {
+		t.Fatalf("got %q, want %q", got, "tenant-42")
+	}
+	if got := p.resolveBucketLabel("not-a-tenant"); got != otherBucketLabel {
+		t.Fatalf("got %q, want %q", got, otherBucketLabel)
+	}
+}
+
+func TestBucketLabelPolicy_resolveBucketLabel_hashBuckets(t *testing.T) {
+	p := &bucketLabelPolicy{hashBuckets: 8}
+	got := p.resolveBucketLabel("some-noisy-tenant-bucket")
+	if got == "some-noisy-tenant-bucket" || got == otherBucketLabel {
+		t.Fatalf("got %q, want a bounded bucket-<n> label", got)
+	}
+	// Hashing must be deterministic for the same input.
+	if again := p.resolveBucketLabel("some-noisy-tenant-bucket"); again != got {
+		t.Fatalf("hash not stable: %q != %q", got, again)
+	}
+}
+
+func TestBucketAllowListFlag_appliesToGlobalPolicy(t *testing.T) {
+	orig := *globalBucketLabelPolicy
+	defer func() { *globalBucketLabelPolicy = orig }()
+
+	if err := flag.CommandLine.Lookup("bucket-allow-list").Value.Set("prod,staging"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := globalBucketLabelPolicy.resolveBucketLabel("prod"); got != "prod" {
+		t.Fatalf("got %q, want %q", got, "prod")
+	}
+	if got := globalBucketLabelPolicy.resolveBucketLabel("unknown"); got != otherBucketLabel {
+		t.Fatalf("got %q, want %q", got, otherBucketLabel)
+	}
+
+	dir := t.TempDir()
+	listFile := filepath.Join(dir, "buckets.txt")
+	if err := os.WriteFile(listFile, []byte("from-file\n# comment\n\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := flag.CommandLine.Lookup("bucket-allow-list").Value.Set(listFile); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := globalBucketLabelPolicy.resolveBucketLabel("from-file"); got != "from-file" {
+		t.Fatalf("got %q, want %q", got, "from-file")
+	}
+
+	if err := flag.CommandLine.Lookup("bucket-allow-regex").Value.Set(`^tenant-\d+$`); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := globalBucketLabelPolicy.resolveBucketLabel("tenant-7"); got != "tenant-7" {
+		t.Fatalf("got %q, want %q", got, "tenant-7")
+	}
+
+	if err := flag.CommandLine.Lookup("bucket-label-hash-buckets").Value.Set("4"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if globalBucketLabelPolicy.hashBuckets != 4 {
+		t.Fatalf("hashBuckets = %v, want 4", globalBucketLabelPolicy.hashBuckets)
+	}
+}
+
+func TestClassifyOperation(t *testing.T) {
+	cases := []struct {
+		method, rawQuery, want string
+	}{
+		{"GET", "", "get_object"},
+		{"HEAD", "", "head_object"},
+		{"PUT", "", "put_object"},
+		{"DELETE", "", "delete_object"},
+		{"POST", "uploads", "multipart_upload"},
+		{"PUT", "uploadId=abc123&partNumber=1", "multipart_upload"},
+		{"GET", "list-type=2&prefix=foo", "list_objects_v2"},
+		{"GET", "versioning", "versioning"},
+		{"PUT", "tagging", "tagging"},
+	}
+	for _, c := range cases {
+		if got := classifyOperation(c.method, c.rawQuery); got != c.want {
+			t.Errorf("classifyOperation(%q, %q) = %q, want %q", c.method, c.rawQuery, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2020 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthCheckInterval and healthCheckPath back --health-check-interval and
+// --health-check-path, the cadence and path runMetricsHealthCheckLoop uses
+// to probe every backend in globalConnStats. healthCheckInterval is only
+// ever touched while holding healthCheckMu.
+var (
+	healthCheckInterval = 5 * time.Second
+	healthCheckPath     = "/minio/health/live"
+
+	healthCheckMu     sync.Mutex
+	healthCheckCancel context.CancelFunc
+)
+
+// healthCheckClient is used for every outbound health-check probe.
+var healthCheckClient = &http.Client{Timeout: 3 * time.Second}
+
+func init() {
+	restartHealthCheckLoop()
+
+	flag.Func("health-check-interval", "how often to probe each backend endpoint for the sidekick_backend_* metrics", func(s string) error {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid --health-check-interval %q: %w", s, err)
+		}
+		healthCheckMu.Lock()
+		healthCheckInterval = d
+		healthCheckMu.Unlock()
+		restartHealthCheckLoop()
+		return nil
+	})
+	flag.StringVar(&healthCheckPath, "health-check-path", healthCheckPath, "path probed on each backend endpoint to determine health")
+}
+
+// restartHealthCheckLoop (re)starts runMetricsHealthCheckLoop with the
+// current healthCheckInterval, cancelling whichever loop it previously
+// started. It's called once at startup with the default interval, and
+// again whenever --health-check-interval is parsed - mirroring
+// rebuildLatencyMetric, since a time.Ticker's period is fixed at
+// NewTicker and a goroutine that read healthCheckInterval once at startup
+// would never observe a later flag-driven change to it.
+func restartHealthCheckLoop() {
+	healthCheckMu.Lock()
+	defer healthCheckMu.Unlock()
+
+	if healthCheckCancel != nil {
+		healthCheckCancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	healthCheckCancel = cancel
+	go runMetricsHealthCheckLoop(ctx, healthCheckInterval)
+}
+
+// runMetricsHealthCheckLoop periodically probes every backend endpoint in
+// globalConnStats and records the outcome via ConnStats.setHealthcheckResult
+// and ConnStats.addOfflineSeconds, feeding sidekick_backend_up,
+// sidekick_backend_healthcheck_duration_seconds,
+// sidekick_backend_healthcheck_failures_total and
+// sidekick_backend_offline_seconds_total, until ctx is cancelled. interval
+// is captured once per call rather than read from the package var, so a
+// restart always runs with a consistent, current interval.
+func runMetricsHealthCheckLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			probeBackendsForMetrics(interval)
+		}
+	}
+}
+
+// probeBackendsForMetrics runs a single round of health checks across every
+// non-nil entry of globalConnStats, accumulating offlineInterval of
+// downtime on each backend still marked down.
+func probeBackendsForMetrics(offlineInterval time.Duration) {
+	for _, stats := range globalConnStats {
+		if stats == nil {
+			continue
+		}
+		up, rtt, reason := probeBackendHealth(stats.endpoint)
+		stats.setHealthcheckResult(up, rtt, reason)
+		if !up {
+			stats.addOfflineSeconds(offlineInterval)
+		}
+	}
+}
+
+// probeBackendHealth issues a single GET against endpoint's health-check
+// path and classifies the outcome. reason is only meaningful when up is
+// false, and matches the "reason" label sidekick_backend_healthcheck_failures_total
+// is broken down by.
+func probeBackendHealth(endpoint string) (up bool, rtt time.Duration, reason string) {
+	start := time.Now()
+	resp, err := healthCheckClient.Get(strings.TrimSuffix(endpoint, "/") + healthCheckPath)
+	rtt = time.Since(start)
+	if err != nil {
+		return false, rtt, "request_error"
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return false, rtt, "status_5xx"
+	}
+	return true, rtt, ""
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProbeBackendHealth(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	up, _, reason := probeBackendHealth(healthy.URL)
+	if !up || reason != "" {
+		t.Fatalf("up = %v, reason = %q, want up with no reason", up, reason)
+	}
+
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthy.Close()
+
+	up, _, reason = probeBackendHealth(unhealthy.URL)
+	if up || reason != "status_5xx" {
+		t.Fatalf("up = %v, reason = %q, want down with status_5xx", up, reason)
+	}
+
+	up, _, reason = probeBackendHealth("http://127.0.0.1:0")
+	if up || reason != "request_error" {
+		t.Fatalf("up = %v, reason = %q, want down with request_error", up, reason)
+	}
+}
+
+func TestProbeBackendsForMetrics(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	globalConnStats = []*ConnStats{nil, newConnStats(healthy.URL)}
+	defer func() { globalConnStats = nil }()
+
+	probeBackendsForMetrics(time.Second)
+}
+
+func TestHealthCheckIntervalFlag_restartsLoopWithNewInterval(t *testing.T) {
+	defer func() {
+		healthCheckMu.Lock()
+		healthCheckInterval = 5 * time.Second
+		healthCheckMu.Unlock()
+		restartHealthCheckLoop()
+	}()
+
+	if err := flag.CommandLine.Lookup("health-check-interval").Value.Set("250ms"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	healthCheckMu.Lock()
+	got := healthCheckInterval
+	healthCheckMu.Unlock()
+	if got != 250*time.Millisecond {
+		t.Fatalf("healthCheckInterval = %v, want 250ms", got)
+	}
+}
@@ -16,43 +16,242 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/atomic"
 )
 
 const errorHTTPStatusCodes = http.StatusNetworkAuthenticationRequired - http.StatusBadRequest + 1
 
+// defaultLatencyBuckets is used when --latency-buckets is not given on the
+// command line. It favours resolution around typical S3 object-storage
+// latencies (low milliseconds to a few seconds).
+var defaultLatencyBuckets = []float64{
+	.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+}
+
+// latencyBucketFactor controls the growth factor of sidekick's native
+// (sparse) histogram, set via --latency-native-histogram-factor. A factor of
+// 0 disables native histograms and falls back to the classic fixed buckets
+// in defaultLatencyBuckets/globalLatencyBuckets.
+var latencyBucketFactor = 1.1
+
+// globalLatencyBuckets holds the effective classic bucket boundaries for
+// latencyMetric, populated from defaultLatencyBuckets or the
+// --latency-buckets flag during startup.
+var globalLatencyBuckets = defaultLatencyBuckets
+
 var (
-	latencyMetric *prometheus.SummaryVec
+	latencyMetric *prometheus.HistogramVec
+
+	backendUpMetric                  *prometheus.GaugeVec
+	backendHealthcheckDurationMetric *prometheus.HistogramVec
+	backendHealthcheckFailuresMetric *prometheus.CounterVec
+	backendOfflineSecondsMetric      *prometheus.CounterVec
+
+	metricLabelsDroppedMetric *prometheus.CounterVec
+)
+
+// exemplarTraceIDKey and exemplarSpanIDKey are the context keys sidekick
+// stamps onto a request's context when forwarding it, so that
+// setAvgLatency can attach an OpenTelemetry-style exemplar to the latency
+// observation that produced it.
+type exemplarContextKey string
+
+const (
+	exemplarTraceIDKey exemplarContextKey = "traceID"
+	exemplarSpanIDKey  exemplarContextKey = "spanID"
 )
 
 func init() {
 	prometheus.MustRegister(newSidekickCollector())
 
-	latencyMetric = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+	rebuildLatencyMetric()
+	flag.Func("latency-buckets", "comma separated list of latency histogram bucket boundaries in seconds, e.g. 0.01,0.05,0.1,0.5,1,5", func(s string) error {
+		buckets, err := parseLatencyBuckets(s)
+		if err != nil {
+			return err
+		}
+		globalLatencyBuckets = buckets
+		rebuildLatencyMetric()
+		return nil
+	})
+	flag.Func("latency-native-histogram-factor", "growth factor for sidekick's native (sparse) latency histogram; 0 disables native histograms", func(s string) error {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid latency-native-histogram-factor %q: %w", s, err)
+		}
+		latencyBucketFactor = v
+		rebuildLatencyMetric()
+		return nil
+	})
+
+	metricLabelsDroppedMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sidekick",
+		Subsystem: "metric",
+		Name:      "labels_dropped_total",
+		Help:      "Total number of times a high-cardinality label value was replaced to protect metric cardinality",
+	}, []string{"label", "reason"})
+	prometheus.MustRegister(metricLabelsDroppedMetric)
+
+	backendUpMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "sidekick",
-		Subsystem: "requests",
-		Name:      "latency",
-		Help:      "HTTP Requests latency in current SideKick server instance",
-		Objectives: map[float64]float64{
-			0.5:  0.05,
-			0.9:  0.01,
-			0.99: 0.001,
-		},
+		Subsystem: "backend",
+		Name:      "up",
+		Help:      "1 if the backend endpoint is currently considered healthy, 0 otherwise",
+	}, []string{"endpoint"})
+	prometheus.MustRegister(backendUpMetric)
+
+	backendHealthcheckDurationMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:                   "sidekick",
+		Subsystem:                   "backend",
+		Name:                        "healthcheck_duration_seconds",
+		Help:                        "Round-trip time of the backend health check",
+		Buckets:                     prometheus.DefBuckets,
+		NativeHistogramBucketFactor: latencyBucketFactor,
+	}, []string{"endpoint"})
+	prometheus.MustRegister(backendHealthcheckDurationMetric)
+
+	backendHealthcheckFailuresMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sidekick",
+		Subsystem: "backend",
+		Name:      "healthcheck_failures_total",
+		Help:      "Total number of failed backend health checks",
+	}, []string{"endpoint", "reason"})
+	prometheus.MustRegister(backendHealthcheckFailuresMetric)
+
+	backendOfflineSecondsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sidekick",
+		Subsystem: "backend",
+		Name:      "offline_seconds_total",
+		Help:      "Cumulative number of seconds the backend endpoint has been marked offline",
+	}, []string{"endpoint"})
+	prometheus.MustRegister(backendOfflineSecondsMetric)
+}
+
+// exemplarFromContext builds the exemplar label set attached to a latency
+// observation from trace/span identifiers stashed on ctx. It returns nil
+// when no trace is in flight, so that callers fall back to a plain
+// Observe() - the Prometheus client rejects empty-but-non-nil label sets.
+func exemplarFromContext(ctx context.Context) prometheus.Labels {
+	if ctx == nil {
+		return nil
+	}
+	traceID, _ := ctx.Value(exemplarTraceIDKey).(string)
+	spanID, _ := ctx.Value(exemplarSpanIDKey).(string)
+	if traceID == "" && spanID == "" {
+		return nil
+	}
+	labels := prometheus.Labels{}
+	if traceID != "" {
+		labels["trace_id"] = traceID
+	}
+	if spanID != "" {
+		labels["span_id"] = spanID
+	}
+	return truncateExemplarLabels(labels)
+}
+
+// truncateExemplarLabels bounds the combined number of runes across an
+// exemplar's label names and values to prometheus.ExemplarMaxRunes.
+// prometheus.(*histogram).updateExemplar panics if that limit is exceeded,
+// so a misbehaving upstream tracer handing setAvgLatency an oversized
+// trace/span ID must not be able to turn a latency observation into a
+// panic - trim the longest value(s) until the set fits instead.
+func truncateExemplarLabels(labels prometheus.Labels) prometheus.Labels {
+	for exemplarRuneCount(labels) > prometheus.ExemplarMaxRunes {
+		longestName, longestRunes := "", 0
+		for name, value := range labels {
+			if n := utf8.RuneCountInString(value); n > longestRunes {
+				longestName, longestRunes = name, n
+			}
+		}
+		if longestRunes == 0 {
+			break
+		}
+		runes := []rune(labels[longestName])
+		labels[longestName] = string(runes[:len(runes)-1])
+	}
+	return labels
+}
+
+// exemplarRuneCount mirrors the size check prometheus.newExemplar performs:
+// the sum of the rune counts of every label name and value.
+func exemplarRuneCount(labels prometheus.Labels) int {
+	n := 0
+	for name, value := range labels {
+		n += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+	}
+	return n
+}
+
+// newLatencyHistogramVec builds latencyMetric's HistogramVec from the
+// current globalLatencyBuckets/latencyBucketFactor values.
+func newLatencyHistogramVec() *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:                       "sidekick",
+		Subsystem:                       "requests",
+		Name:                            "latency_seconds",
+		Help:                            "HTTP Requests latency in current SideKick server instance",
+		Buckets:                         globalLatencyBuckets,
+		NativeHistogramBucketFactor:     latencyBucketFactor,
+		NativeHistogramMaxBucketNumber:  160,
+		NativeHistogramMinResetDuration: time.Hour,
 	}, []string{
 		"endpoint",
 		"method",
 		"bucket",
+		"op",
+		"status_code",
 	})
+}
+
+// rebuildLatencyMetric (re)creates latencyMetric from the current bucket
+// configuration and re-registers it, replacing any previous registration.
+// It is called once at startup with the defaults, and again whenever
+// --latency-buckets or --latency-native-histogram-factor is parsed, since
+// the bucket layout of a prometheus.Histogram is fixed at construction
+// time and can't be mutated in place.
+func rebuildLatencyMetric() {
+	if latencyMetric != nil {
+		prometheus.Unregister(latencyMetric)
+	}
+	latencyMetric = newLatencyHistogramVec()
 	prometheus.MustRegister(latencyMetric)
 }
 
+// parseLatencyBuckets parses the comma-separated list of bucket boundaries
+// (in seconds) passed via --latency-buckets, e.g. "0.01,0.05,0.1,0.5,1,5".
+func parseLatencyBuckets(s string) ([]float64, error) {
+	fields := strings.Split(s, ",")
+	buckets := make([]float64, 0, len(fields))
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latency bucket %q: %w", field, err)
+		}
+		buckets = append(buckets, v)
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("latency-buckets must contain at least one boundary")
+	}
+	return buckets, nil
+}
+
 // newSidekickCollector describes the collector
 // and returns reference of sidekickCollector
 // It creates the Prometheus Description which is used
@@ -133,16 +332,34 @@ func metricsHandler() (http.Handler, error) {
 		return nil, err
 	}
 
+	// Surface Go runtime and process-level metrics (GC pauses, goroutine
+	// counts, RSS, file descriptors, ...) per sidekick instance, alongside
+	// the backend-specific metrics above.
+	if err = registry.Register(collectors.NewGoCollector(
+		collectors.WithGoCollectorRuntimeMetrics(collectors.MetricsAll),
+	)); err != nil {
+		return nil, err
+	}
+	if err = registry.Register(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{})); err != nil {
+		return nil, err
+	}
+
 	gatherers := prometheus.Gatherers{
 		prometheus.DefaultGatherer,
 		registry,
 	}
-	// Delegate http serving to Prometheus client library, which will call collector.Collect.
+	// Delegate http serving to Prometheus client library, which will call
+	// collector.Collect. EnableOpenMetrics lets promhttp negotiate the
+	// response format against the request's Accept header, so a client
+	// asking for application/openmetrics-text gets exemplars, counter
+	// _created timestamps and unit metadata alongside the classic text
+	// exposition format.
 	return promhttp.InstrumentMetricHandler(
 		registry,
 		promhttp.HandlerFor(gatherers,
 			promhttp.HandlerOpts{
-				ErrorHandling: promhttp.ContinueOnError,
+				ErrorHandling:     promhttp.ContinueOnError,
+				EnableOpenMetrics: true,
 			}),
 	), nil
 }
@@ -186,12 +403,25 @@ func (s *ConnStats) setTotalCallFailures(n [errorHTTPStatusCodes]int64) {
 }
 
 // setAvgLatency - set avg latency
-func (s *ConnStats) setAvgLatency(mn time.Duration, method, path string) {
-	latencyMetric.WithLabelValues(
+//
+// ctx carries the in-flight request's trace/span IDs (if any); when
+// present, the observation is recorded with an exemplar pointing back at
+// the trace that produced it. rawQuery is the request's undecoded query
+// string, used to classify the S3 operation (op label) independently of
+// the bucket label.
+func (s *ConnStats) setAvgLatency(ctx context.Context, mn time.Duration, method, path, rawQuery string, statusCode int) {
+	observer := latencyMetric.WithLabelValues(
 		s.endpoint,
 		method,
-		getBucketFromPath(path),
-	).Observe(float64(mn))
+		globalBucketLabelPolicy.resolveBucketLabel(getBucketFromPath(path)),
+		classifyOperation(method, rawQuery),
+		strconv.Itoa(statusCode),
+	)
+	if exemplar := exemplarFromContext(ctx); exemplar != nil {
+		observer.(prometheus.ExemplarObserver).ObserveWithExemplar(mn.Seconds(), exemplar)
+		return
+	}
+	observer.Observe(mn.Seconds())
 }
 
 // getBucketFromPath - extract bucket name from http requests path
@@ -232,3 +462,24 @@ func (s *ConnStats) getTotalOutputBytes() uint64 {
 func newConnStats(endpoint string) *ConnStats {
 	return &ConnStats{endpoint: endpoint}
 }
+
+// setHealthcheckResult records the outcome of a single backend health
+// check: it observes the round-trip time, flips the up/down gauge, and on
+// failure bumps the failures counter for reason (probeBackendHealth reports
+// "request_error" or "status_5xx").
+func (s *ConnStats) setHealthcheckResult(up bool, rtt time.Duration, reason string) {
+	backendHealthcheckDurationMetric.WithLabelValues(s.endpoint).Observe(rtt.Seconds())
+	if up {
+		backendUpMetric.WithLabelValues(s.endpoint).Set(1)
+		return
+	}
+	backendUpMetric.WithLabelValues(s.endpoint).Set(0)
+	backendHealthcheckFailuresMetric.WithLabelValues(s.endpoint, reason).Inc()
+}
+
+// addOfflineSeconds accumulates the time the backend has spent marked
+// offline, called by the health-check loop on each tick the endpoint stays
+// down.
+func (s *ConnStats) addOfflineSeconds(d time.Duration) {
+	backendOfflineSecondsMetric.WithLabelValues(s.endpoint).Add(d.Seconds())
+}
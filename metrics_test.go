@@ -1,13 +1,137 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"math/rand"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func TestConnStats_setAvgLatency(t *testing.T) {
-	newConnStats("test").setAvgLatency(time.Duration(rand.Int63()), "GET", "")
-	newConnStats("test").setAvgLatency(time.Duration(rand.Int63()), "GET", "/")
-	newConnStats("test").setAvgLatency(time.Duration(rand.Int63()), "GET", "/core-data/Cheques/dbo__cheques")
+	ctx := context.Background()
+	newConnStats("test").setAvgLatency(ctx, time.Duration(rand.Int63()), "GET", "", "", 200)
+	newConnStats("test").setAvgLatency(ctx, time.Duration(rand.Int63()), "GET", "/", "", 200)
+	newConnStats("test").setAvgLatency(ctx, time.Duration(rand.Int63()), "GET", "/core-data/Cheques/dbo__cheques", "", 500)
+}
+
+func TestParseLatencyBuckets(t *testing.T) {
+	buckets, err := parseLatencyBuckets(" 0.01,0.05 ,0.1,0.5,1,5")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []float64{0.01, 0.05, 0.1, 0.5, 1, 5}
+	if len(buckets) != len(want) {
+		t.Fatalf("got %v buckets, want %v", buckets, want)
+	}
+	for i := range want {
+		if buckets[i] != want[i] {
+			t.Fatalf("got %v buckets, want %v", buckets, want)
+		}
+	}
+
+	if _, err := parseLatencyBuckets("0.1,nope"); err == nil {
+		t.Fatal("expected error for invalid bucket value")
+	}
+
+	if _, err := parseLatencyBuckets(""); err == nil {
+		t.Fatal("expected error for empty bucket list")
+	}
+}
+
+func TestConnStats_setAvgLatency_withExemplar(t *testing.T) {
+	ctx := context.WithValue(context.Background(), exemplarTraceIDKey, "4bf92f3577b34da6a3ce929d0e0e4736")
+	ctx = context.WithValue(ctx, exemplarSpanIDKey, "00f067aa0ba902b7")
+	newConnStats("test").setAvgLatency(ctx, time.Duration(rand.Int63()), "GET", "/bucket/object", "", 200)
+}
+
+func TestTruncateExemplarLabels_boundsTotalRunes(t *testing.T) {
+	oversized := strings.Repeat("a", 500)
+	labels := truncateExemplarLabels(prometheus.Labels{
+		"trace_id": oversized,
+		"span_id":  oversized,
+	})
+	if n := exemplarRuneCount(labels); n > prometheus.ExemplarMaxRunes {
+		t.Fatalf("exemplarRuneCount = %d, want <= %d", n, prometheus.ExemplarMaxRunes)
+	}
+}
+
+func TestConnStats_setAvgLatency_withOversizedTraceID(t *testing.T) {
+	ctx := context.WithValue(context.Background(), exemplarTraceIDKey, strings.Repeat("a", 10000))
+	ctx = context.WithValue(ctx, exemplarSpanIDKey, strings.Repeat("b", 10000))
+	// Must not panic - see prometheus.newExemplar's ExemplarMaxRunes check.
+	newConnStats("test").setAvgLatency(ctx, time.Millisecond, "GET", "/bucket/object", "", 200)
+}
+
+func TestRebuildLatencyMetric_appliesFlagValues(t *testing.T) {
+	origBuckets, origFactor := globalLatencyBuckets, latencyBucketFactor
+	defer func() {
+		globalLatencyBuckets, latencyBucketFactor = origBuckets, origFactor
+		rebuildLatencyMetric()
+	}()
+
+	if err := flag.CommandLine.Lookup("latency-buckets").Value.Set("0.1,1,10"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []float64{0.1, 1, 10}; len(globalLatencyBuckets) != len(want) {
+		t.Fatalf("globalLatencyBuckets = %v, want %v", globalLatencyBuckets, want)
+	}
+
+	if err := flag.CommandLine.Lookup("latency-native-histogram-factor").Value.Set("1.5"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if latencyBucketFactor != 1.5 {
+		t.Fatalf("latencyBucketFactor = %v, want 1.5", latencyBucketFactor)
+	}
+
+	newConnStats("test").setAvgLatency(context.Background(), time.Millisecond, "GET", "/bucket", "", 200)
+}
+
+func TestConnStats_setHealthcheckResult(t *testing.T) {
+	s := newConnStats("health-test")
+	s.setHealthcheckResult(true, 5*time.Millisecond, "")
+	s.setHealthcheckResult(false, 50*time.Millisecond, "timeout")
+	s.addOfflineSeconds(2 * time.Second)
+}
+
+func TestMetricsHandler_registersRuntimeCollectors(t *testing.T) {
+	handler, err := metricsHandler()
+	if err != nil {
+		t.Fatalf("metricsHandler: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	body := rec.Body.String()
+	for _, want := range []string{"go_goroutines", "process_resident_memory_bytes"} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in /metrics output", want)
+		}
+	}
+}
+
+func TestMetricsHandler_openMetricsNegotiation(t *testing.T) {
+	handler, err := metricsHandler()
+	if err != nil {
+		t.Fatalf("metricsHandler: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	ct := rec.Header().Get("Content-Type")
+	if !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Fatalf("Content-Type = %q, want application/openmetrics-text prefix", ct)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(rec.Body.String()), "# EOF") {
+		t.Fatalf("OpenMetrics body must end with # EOF, got: %q", rec.Body.String())
+	}
 }
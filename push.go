@@ -0,0 +1,157 @@
+// Copyright (c) 2020 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// defaultPushJob is used when --push-job is not given on the command line.
+const defaultPushJob = "sidekick"
+
+// defaultPushInterval is used when --push-interval is not given.
+const defaultPushInterval = 10 * time.Second
+
+// pushGatewayURL, pushJob and pushInterval back --push-gateway, --push-job
+// and --push-interval. pushGatewayURL being empty (the default) means the
+// Pushgateway integration is disabled.
+var (
+	pushGatewayURL    string
+	pushJob           = defaultPushJob
+	pushInterval      = defaultPushInterval
+	pushBasicAuthUser string
+	pushBasicAuthPass string
+	pushGroupingFlag  pushGrouping
+)
+
+// pushGrouping implements flag.Value so --push-grouping can be repeated on
+// the command line, e.g. --push-grouping region=us-east-1 --push-grouping
+// az=a, to build the grouping label set handed to push.Pusher.Grouping.
+type pushGrouping []string
+
+func (g *pushGrouping) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *pushGrouping) Set(pair string) error {
+	if _, _, ok := strings.Cut(pair, "="); !ok {
+		return fmt.Errorf("invalid --push-grouping %q, expected k=v", pair)
+	}
+	*g = append(*g, pair)
+	return nil
+}
+
+func init() {
+	flag.StringVar(&pushGatewayURL, "push-gateway", "", "URL of a Prometheus Pushgateway to periodically push sidekick's metrics to")
+	flag.StringVar(&pushJob, "push-job", defaultPushJob, "job label to push sidekick's metrics under")
+	flag.DurationVar(&pushInterval, "push-interval", defaultPushInterval, "how often to push metrics to the Pushgateway")
+	flag.StringVar(&pushBasicAuthUser, "push-basic-auth-user", "", "basic auth username for the Pushgateway, if required")
+	flag.StringVar(&pushBasicAuthPass, "push-basic-auth-password", "", "basic auth password for the Pushgateway, if required")
+	flag.Var(&pushGroupingFlag, "push-grouping", "grouping label k=v for the Pushgateway job, may be repeated")
+}
+
+// startPushgatewayIfConfigured builds a Pusher from the push-* flags and
+// runs it until the process receives SIGINT/SIGTERM, performing a final
+// push on the way out. It is a no-op if --push-gateway was never set.
+//
+// Call this once from main(), after flag.Parse() has returned, e.g.
+// "go startPushgatewayIfConfigured()". It must not be launched from init()
+// or otherwise raced against flag.Parse(): it reads pushGatewayURL and
+// friends, which flag.Parse() sets, and the flag package does not
+// synchronize Parse() against concurrent reads of the values it sets.
+func startPushgatewayIfConfigured() {
+	if pushGatewayURL == "" {
+		return
+	}
+
+	grouping, err := parsePushGrouping(pushGroupingFlag)
+	if err != nil {
+		log.Printf("sidekick: invalid --push-grouping, pushgateway integration disabled: %v", err)
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	pusher := newPusher(pushGatewayURL, pushJob, grouping, pushBasicAuthUser, pushBasicAuthPass)
+	startPusher(ctx, pusher, pushInterval)
+}
+
+// parsePushGrouping parses the repeated `k=v` values passed via
+// --push-grouping into the grouping label set handed to push.Pusher.Grouping.
+func parsePushGrouping(pairs []string) (map[string]string, error) {
+	grouping := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid --push-grouping %q, expected k=v", pair)
+		}
+		grouping[k] = v
+	}
+	return grouping, nil
+}
+
+// newPusher builds a Pusher that ships the default sidekick registry
+// (everything registered via prometheus.MustRegister in metrics.go) to a
+// Prometheus Pushgateway at url, under job, with the given grouping
+// labels and optional HTTP basic auth.
+func newPusher(url, job string, grouping map[string]string, basicAuthUser, basicAuthPass string) *push.Pusher {
+	pusher := push.New(url, job).Gatherer(prometheus.DefaultGatherer)
+	for name, value := range grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	if basicAuthUser != "" {
+		pusher = pusher.BasicAuth(basicAuthUser, basicAuthPass)
+	}
+	return pusher
+}
+
+// startPusher periodically pushes the sidekick registry to a Pushgateway
+// every interval until ctx is cancelled, at which point it performs one
+// final push (best-effort) before returning - so counters accumulated by a
+// short-lived sidekick invocation aren't lost on graceful shutdown.
+//
+// It is meant to be run in its own goroutine, e.g.:
+//
+//	go startPusher(ctx, pusher, interval)
+func startPusher(ctx context.Context, pusher *push.Pusher, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := pusher.Push(); err != nil {
+				log.Printf("sidekick: unable to push metrics to pushgateway: %v", err)
+			}
+		case <-ctx.Done():
+			if err := pusher.Push(); err != nil {
+				log.Printf("sidekick: unable to push final metrics to pushgateway: %v", err)
+			}
+			return
+		}
+	}
+}
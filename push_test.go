@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestParsePushGrouping(t *testing.T) {
+	grouping, err := parsePushGrouping([]string{"region=us-east-1", "instance=sidekick-1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if grouping["region"] != "us-east-1" || grouping["instance"] != "sidekick-1" {
+		t.Fatalf("unexpected grouping: %#v", grouping)
+	}
+
+	if _, err := parsePushGrouping([]string{"no-equals-sign"}); err == nil {
+		t.Fatal("expected error for malformed grouping pair")
+	}
+
+	if _, err := parsePushGrouping([]string{"=value"}); err == nil {
+		t.Fatal("expected error for missing key")
+	}
+}
+
+func TestNewPusher(t *testing.T) {
+	pusher := newPusher("http://localhost:9091", defaultPushJob, map[string]string{"endpoint": "node1"}, "", "")
+	if pusher == nil {
+		t.Fatal("expected non-nil pusher")
+	}
+}
+
+func TestStartPushgatewayIfConfigured_noOpWithoutGatewayURL(t *testing.T) {
+	orig := pushGatewayURL
+	pushGatewayURL = ""
+	defer func() { pushGatewayURL = orig }()
+
+	// Must return immediately rather than blocking - safe for main() to call
+	// synchronously before deciding whether to background it.
+	startPushgatewayIfConfigured()
+}